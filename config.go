@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// RouteConfig describes one entry of routes.yaml: where to fetch a
+// route's CSV and schema from, and how to parse the CSV.
+type RouteConfig struct {
+	CSV    string        `yaml:"csv"`
+	Schema string        `yaml:"schema"`
+	Format string        `yaml:"format"`
+	Update UpdaterConfig `yaml:"update"`
+}
+
+// delimiter returns the field separator implied by Format, defaulting
+// to comma when Format is empty or "csv".
+func (config RouteConfig) delimiter() rune {
+	if config.Format == "tsv" {
+		return '\t'
+	}
+	return ','
+}
+
+// loadRoutesConfig reads a routes.yaml file and mounts every route it
+// describes, starting a background refresh goroutine for any route
+// whose CSV is fetched over http(s).
+func loadRoutesConfig(path string, routes *DataRoutes) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]RouteConfig
+	if err := yaml.Unmarshal(raw, &config); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for route, entry := range config {
+		raw, err := readSchemaBytes(entry.Schema)
+		if err != nil {
+			return fmt.Errorf("route %q: %v", route, err)
+		}
+		if looksLikeVariantList(raw) {
+			variants, err := readVariants(raw, entry.Schema)
+			if err != nil {
+				return fmt.Errorf("route %q: %v", route, err)
+			}
+			routes.InsertVariants(route, variants)
+			continue
+		}
+		schema, err := schemaFromBytes(raw, entry.Schema)
+		if err != nil {
+			return fmt.Errorf("route %q: %v", route, err)
+		}
+		data, err := readCSVData(entry.CSV, schema, entry.delimiter())
+		if err != nil {
+			return fmt.Errorf("route %q: %v", route, err)
+		}
+		updater, err := buildUpdater(entry.Update, entry.CSV)
+		if err != nil {
+			return fmt.Errorf("route %q: %v", route, err)
+		}
+		routes.Insert(route, *data, updater)
+		go watchForUpdates(route, entry.CSV, schema, entry.delimiter(), routes)
+	}
+	return nil
+}
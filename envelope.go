@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// envelopeMode controls how responses are shaped. envelopeBare
+// mirrors serve-csv's historical output (a bare array/object, and a
+// simple {"error": "..."} on failure) so existing consumers don't
+// break. envelopeData wraps successes as {"data": ..., "meta": ...}
+// and errors as the JSON:API-style {"errors": [...]} shape tools like
+// SuperGraph expect.
+type envelopeMode string
+
+const (
+	envelopeBare envelopeMode = "bare"
+	envelopeData envelopeMode = "data"
+)
+
+// apiError is one entry of a JSON:API-style error response.
+type apiError struct {
+	Status string      `json:"status"`
+	Detail string      `json:"detail"`
+	Source errorSource `json:"source"`
+}
+
+type errorSource struct {
+	Route string `json:"route"`
+}
+
+// writeSuccess renders a successful response in mode's shape. meta is
+// only included (and only in envelopeData mode) when non-nil, since
+// not every response carries pagination metadata.
+func writeSuccess(w http.ResponseWriter, mode envelopeMode, payload interface{}, meta *queryMeta) {
+	var body []byte
+	if mode == envelopeData {
+		envelope := struct {
+			Data interface{} `json:"data"`
+			Meta *queryMeta  `json:"meta,omitempty"`
+		}{payload, meta}
+		body, _ = json.Marshal(envelope)
+	} else {
+		body, _ = json.Marshal(payload)
+	}
+	w.Write(body)
+}
+
+// writeError renders err as an HTTP response in mode's error shape.
+// Using json.Marshal throughout means a quote or backslash in the
+// error message can never produce invalid JSON, unlike the old
+// fmt.Fprintf(`{"error": "%v"}`) approach.
+func writeError(w http.ResponseWriter, mode envelopeMode, status int, route string, err error) {
+	w.WriteHeader(status)
+	var body []byte
+	if mode == envelopeData {
+		envelope := struct {
+			Errors []apiError `json:"errors"`
+		}{[]apiError{{
+			Status: strconv.Itoa(status),
+			Detail: err.Error(),
+			Source: errorSource{Route: route},
+		}}}
+		body, _ = json.Marshal(envelope)
+	} else {
+		envelope := struct {
+			Error string `json:"error"`
+		}{err.Error()}
+		body, _ = json.Marshal(envelope)
+	}
+	w.Write(body)
+}
@@ -5,14 +5,17 @@ import (
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/alecthomas/kingpin"
+	"github.com/xeipuuv/gojsonschema"
 )
 
 // dirFileNames returns a list of file names in a given directory
@@ -36,8 +39,12 @@ type dataPath struct {
 	json  string
 }
 
-// matchDataPaths tries to match up dataPairs given a list of paths
-// this will error if a CSV file is missing a corresponding JSON schema.
+// matchDataPaths tries to match up dataPairs given a list of paths.
+// Every .json file becomes a route; a paired <name>.csv is only
+// required when the JSON file turns out to hold a flat schema, since
+// a route's JSON file can instead be a list of response variants that
+// name their own CSVs (see readVariants). A CSV file with no matching
+// .json schema is always an error.
 func matchDataPaths(root string, paths []string) ([]dataPath, error) {
 	var csvs []string
 	var jsons []string
@@ -49,125 +56,67 @@ func matchDataPaths(root string, paths []string) ([]dataPath, error) {
 			jsons = append(jsons, path[:len(path)-len(".json")])
 		}
 	}
-	var results []dataPath
-	for _, csv := range csvs {
-		found := false
-		for _, json := range jsons {
-			if csv == json {
-				found = true
-				route := csv
-				csv := fmt.Sprintf("%s%s.csv", root, csv)
-				json := fmt.Sprintf("%s%s.json", root, json)
-				results = append(results, dataPath{route, csv, json})
-			}
-		}
-		if !found {
-			return nil, fmt.Errorf("CSV file %s has no corresponding %s.json schema", csv, csv)
-		}
+	jsonSet := make(map[string]bool, len(jsons))
+	for _, stem := range jsons {
+		jsonSet[stem] = true
 	}
-	return results, nil
-}
-
-// RawSchema holds the raw structure of a schema
-type RawSchema struct {
-	Fields []string
-	Types  []string
-}
-
-// readSchema attempts to read a JSON file's CSV schema.
-// This can fail because of IO, or because of an invalid schema.
-func readSchema(path string) (*RawSchema, error) {
-	var schema RawSchema
-	bytes, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
+	csvSet := make(map[string]bool, len(csvs))
+	for _, stem := range csvs {
+		csvSet[stem] = true
 	}
-	if err := json.Unmarshal(bytes, &schema); err != nil {
-		return nil, err
+	for _, stem := range csvs {
+		if !jsonSet[stem] {
+			return nil, fmt.Errorf("CSV file %s has no corresponding %s.json schema", stem, stem)
+		}
 	}
-	return &schema, nil
-}
-
-// SchemaType represents the valid types for CSV fields
-type SchemaType int
-
-const (
-	// INT represents an integer field
-	INT SchemaType = iota
-	// STRING represents a string field
-	STRING
-)
-
-// Schema holds a set of Fields and corresponding Types
-// Unlike RawSchema, we've made sure these have the same length,
-// and that all the declared types are valid.
-type Schema struct {
-	Fields []string
-	Types  []SchemaType
-}
-
-// validate a schema, returning nil if no errors occurred.
-// This will check that the schema itself is valid, not whether
-// or not it applies to the given CSV file.
-func (schema *RawSchema) validate() (*Schema, error) {
-	fieldsLen := len(schema.Fields)
-	typesLen := len(schema.Types)
-	if fieldsLen != typesLen {
-		return nil, fmt.Errorf("Mismatched fields and types lengths: %d %d", fieldsLen, typesLen)
-	}
-	var types []SchemaType
-	for _, typeString := range schema.Types {
-		var validType SchemaType
-		switch typeString {
-		case "int":
-			validType = INT
-		case "string":
-			validType = STRING
-		default:
-			return nil, fmt.Errorf("Unrecognized schema type: %s", typeString)
+	var results []dataPath
+	for _, stem := range jsons {
+		path := dataPath{route: stem, json: fmt.Sprintf("%s%s.json", root, stem)}
+		if csvSet[stem] {
+			path.csv = fmt.Sprintf("%s%s.csv", root, stem)
 		}
-		types = append(types, validType)
+		results = append(results, path)
 	}
-	return &Schema{schema.Fields, types}, nil
+	return results, nil
 }
 
-// CSVData holds the data contained in a CSV file.
+// CSVData holds the data contained in a CSV file, already coerced and
+// validated against its Schema.
 type CSVData struct {
-	rows   [][]interface{}
+	rows   []map[string]interface{}
 	Schema *Schema
 }
 
-// readCSVData will read the data in a file, checking it against a schema
-// This will return an error as soon as any row doesn't match the given schema.
-func readCSVData(path string, schema *Schema) (*CSVData, error) {
-	file, err := os.Open(path)
+// readCSVData will read the data behind a URL, checking it against a
+// schema. This will return an error as soon as any row doesn't match
+// the given schema. delimiter selects the field separator (',' for
+// CSV, '\t' for TSV); a zero value defaults to comma.
+func readCSVData(path string, schema *Schema, delimiter rune) (*CSVData, error) {
+	reader, err := openSource(path)
 	if err != nil {
 		return nil, err
 	}
-	reader := csv.NewReader(bufio.NewReader(file))
-	records, err := reader.ReadAll()
+	defer reader.Close()
+	return parseCSVData(reader, schema, delimiter, path)
+}
+
+// parseCSVData parses records out of r and coerces/validates each one
+// against schema. label is used to identify the source in error
+// messages.
+func parseCSVData(r io.Reader, schema *Schema, delimiter rune, label string) (*CSVData, error) {
+	csvReader := csv.NewReader(bufio.NewReader(r))
+	if delimiter != 0 {
+		csvReader.Comma = delimiter
+	}
+	records, err := csvReader.ReadAll()
 	if err != nil {
 		return nil, err
 	}
-	rows := make([][]interface{}, 0, len(records))
+	rows := make([]map[string]interface{}, 0, len(records))
 	for rowI, record := range records {
-		recordLen := len(record)
-		schemaLen := len(schema.Types)
-		if recordLen != schemaLen {
-			return nil, fmt.Errorf("%s: row %d: bad record length, expected %d, got %d", path, rowI, schemaLen, recordLen)
-		}
-		row := make([]interface{}, len(schema.Types))
-		for i, typ := range schema.Types {
-			switch typ {
-			case INT:
-				num, err := strconv.ParseInt(record[i], 10, 64)
-				if err != nil {
-					return nil, fmt.Errorf("%s: row %d: %v", path, rowI, err)
-				}
-				row[i] = num
-			case STRING:
-				row[i] = record[i]
-			}
+		row, err := schema.coerceRow(record)
+		if err != nil {
+			return nil, fmt.Errorf("%s: row %d: %v", label, rowI, err)
 		}
 		rows = append(rows, row)
 	}
@@ -175,107 +124,285 @@ func readCSVData(path string, schema *Schema) (*CSVData, error) {
 	return &data, nil
 }
 
-// jsonNth returns the nth row of data as a JSON byte string.
-func (data CSVData) jsonNth(index int) ([]byte, error) {
+// nth returns the nth row of data.
+func (data CSVData) nth(index int) (map[string]interface{}, error) {
 	if index < 0 || index >= len(data.rows) {
 		return nil, fmt.Errorf("index %d out of bounds", index)
 	}
-	row := data.rows[index]
-	mp := make(map[string]interface{})
-	for i, val := range row {
-		mp[data.Schema.Fields[i]] = val
-	}
-	json, err := json.Marshal(mp)
-	// If we can't encode the json, this is a problem with how our schema is designed
-	if err != nil {
-		panic(err)
-	}
-	return json, nil
+	return data.rows[index], nil
 }
 
-// jsonAll returns a JSON array containing all the data
-func (data *CSVData) jsonAll() []byte {
-	rows := make([]map[string]interface{}, 0, len(data.rows))
-	for _, row := range data.rows {
-		mp := make(map[string]interface{})
-		for i, val := range row {
-			mp[data.Schema.Fields[i]] = val
+// routeEntry holds a route's response variants. The common case (an
+// ordinary flat schema file) produces a single variant with no match
+// schema; a variant-list JSON file (see readVariants) produces one
+// per declared variant.
+type routeEntry struct {
+	variants []routeVariant
+}
+
+// selectVariant returns the first variant whose match schema accepts
+// payload, falling back to the first variant with no match schema
+// (the default). For the common single-variant route, that lone
+// variant has no match and is always selected regardless of payload.
+func (entry *routeEntry) selectVariant(payload map[string]interface{}) (*routeVariant, error) {
+	var fallback *routeVariant
+	for i := range entry.variants {
+		v := &entry.variants[i]
+		if v.match == nil {
+			if fallback == nil {
+				fallback = v
+			}
+			continue
+		}
+		result, err := v.match.Validate(gojsonschema.NewGoLoader(payload))
+		if err != nil {
+			return nil, err
+		}
+		if result.Valid() {
+			return v, nil
 		}
-		rows = append(rows, mp)
 	}
-	json, err := json.Marshal(rows)
-	// We should always be able to encode our json
-	if err != nil {
-		panic(err)
+	if fallback != nil {
+		return fallback, nil
 	}
-	return json
+	return nil, fmt.Errorf("no response variant matched the request")
 }
 
-// DataRoutes matches up route paths to CSVData
+// DataRoutes matches up route paths to their response variants,
+// guarding concurrent reads and writes with a RWMutex.
 type DataRoutes struct {
-	routes map[string]CSVData
+	mu     sync.RWMutex
+	routes map[string]*routeEntry
 }
 
 // NewDataRoutes creates a new DataRoutes struct
 // This is necessary since the zero value can't be used.
 func NewDataRoutes() *DataRoutes {
-	return &DataRoutes{routes: make(map[string]CSVData)}
+	return &DataRoutes{routes: make(map[string]*routeEntry)}
+}
+
+// Insert registers a route backed by a single CSV dataset, using
+// updater (nil for a read-only route) to persist any future writes.
+func (routes *DataRoutes) Insert(route string, data CSVData, updater Updater) {
+	routes.mu.Lock()
+	defer routes.mu.Unlock()
+	routes.routes[route] = &routeEntry{variants: []routeVariant{{data: data, updater: updater}}}
+}
+
+// InsertVariants registers a route backed by several schema-matched
+// response variants (see readVariants).
+func (routes *DataRoutes) InsertVariants(route string, variants []routeVariant) {
+	routes.mu.Lock()
+	defer routes.mu.Unlock()
+	routes.routes[route] = &routeEntry{variants: variants}
+}
+
+// Swap atomically replaces the CSVData of a single-variant route's
+// lone variant, without touching its Updater. Background refresh
+// goroutines use this so requests never observe a route mid-reload.
+func (routes *DataRoutes) Swap(route string, data CSVData) {
+	routes.mu.Lock()
+	defer routes.mu.Unlock()
+	if entry, ok := routes.routes[route]; ok && len(entry.variants) > 0 {
+		entry.variants[0].data = data
+	}
+}
+
+// GetAll returns the rows of the route/matchPayload's selected
+// variant that match q, along with pagination metadata describing
+// the page returned.
+func (routes *DataRoutes) GetAll(route string, q *rowQuery, matchPayload map[string]interface{}) ([]map[string]interface{}, queryMeta, error) {
+	routes.mu.RLock()
+	defer routes.mu.RUnlock()
+	entry, ok := routes.routes[route]
+	if !ok {
+		return nil, queryMeta{}, fmt.Errorf("Unknown route: %s", route)
+	}
+	variant, err := entry.selectVariant(matchPayload)
+	if err != nil {
+		return nil, queryMeta{}, &queryError{err.Error()}
+	}
+	return variant.data.applyQuery(q)
 }
 
-// Insert adds a new batch of CSVData
-func (routes *DataRoutes) Insert(route string, data CSVData) {
-	routes.routes[route] = data
+// GetNth returns the nth row of the route/matchPayload's selected variant.
+func (routes *DataRoutes) GetNth(route string, index int, matchPayload map[string]interface{}) (map[string]interface{}, error) {
+	routes.mu.RLock()
+	defer routes.mu.RUnlock()
+	entry, ok := routes.routes[route]
+	if !ok {
+		return nil, fmt.Errorf("Unknown route: %s", route)
+	}
+	variant, err := entry.selectVariant(matchPayload)
+	if err != nil {
+		return nil, &queryError{err.Error()}
+	}
+	return variant.data.nth(index)
 }
 
-// GetAll returns a JSON blob holding all the rows of a route
-func (routes *DataRoutes) GetAll(route string) ([]byte, error) {
-	data, ok := routes.routes[route]
+// Append decodes body, uses it to pick a response variant, validates
+// it against that variant's schema and, if it passes, adds it as a
+// new row and persists the change.
+func (routes *DataRoutes) Append(route string, body []byte) (map[string]interface{}, error) {
+	routes.mu.Lock()
+	defer routes.mu.Unlock()
+	entry, ok := routes.routes[route]
 	if !ok {
 		return nil, fmt.Errorf("Unknown route: %s", route)
 	}
-	return data.jsonAll(), nil
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, &queryError{fmt.Sprintf("invalid JSON body: %v", err)}
+	}
+	variant, err := entry.selectVariant(payload)
+	if err != nil {
+		return nil, &queryError{err.Error()}
+	}
+	if variant.updater == nil {
+		return nil, &queryError{"route is read-only"}
+	}
+	row, err := variant.data.Schema.coerceRequestRow(body)
+	if err != nil {
+		return nil, &queryError{err.Error()}
+	}
+	variant.data.rows = append(variant.data.rows, row)
+	if err := variant.persist(); err != nil {
+		return nil, err
+	}
+	return row, nil
 }
 
-// GetNth returns a JSON blob for the nth item of a route
-func (routes *DataRoutes) GetNth(route string, index int) ([]byte, error) {
-	data, ok := routes.routes[route]
+// Replace decodes body, uses it to pick a response variant, validates
+// it against that variant's schema and, if it passes, overwrites the
+// row at index, persisting the change.
+func (routes *DataRoutes) Replace(route string, index int, body []byte) (map[string]interface{}, error) {
+	routes.mu.Lock()
+	defer routes.mu.Unlock()
+	entry, ok := routes.routes[route]
 	if !ok {
 		return nil, fmt.Errorf("Unknown route: %s", route)
 	}
-	return data.jsonNth(index)
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, &queryError{fmt.Sprintf("invalid JSON body: %v", err)}
+	}
+	variant, err := entry.selectVariant(payload)
+	if err != nil {
+		return nil, &queryError{err.Error()}
+	}
+	if variant.updater == nil {
+		return nil, &queryError{"route is read-only"}
+	}
+	if index < 0 || index >= len(variant.data.rows) {
+		return nil, fmt.Errorf("index %d out of bounds", index)
+	}
+	row, err := variant.data.Schema.coerceRequestRow(body)
+	if err != nil {
+		return nil, &queryError{err.Error()}
+	}
+	variant.data.rows[index] = row
+	if err := variant.persist(); err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+// Delete removes the row at index from the route/matchPayload's
+// selected variant, persisting the change.
+func (routes *DataRoutes) Delete(route string, index int, matchPayload map[string]interface{}) error {
+	routes.mu.Lock()
+	defer routes.mu.Unlock()
+	entry, ok := routes.routes[route]
+	if !ok {
+		return fmt.Errorf("Unknown route: %s", route)
+	}
+	variant, err := entry.selectVariant(matchPayload)
+	if err != nil {
+		return &queryError{err.Error()}
+	}
+	if variant.updater == nil {
+		return &queryError{"route is read-only"}
+	}
+	if index < 0 || index >= len(variant.data.rows) {
+		return fmt.Errorf("index %d out of bounds", index)
+	}
+	variant.data.rows = append(variant.data.rows[:index], variant.data.rows[index+1:]...)
+	return variant.persist()
 }
 
 var (
-	dir  = kingpin.Arg("dir", "The directory to serve").Required().String()
-	port = kingpin.Flag("port", "The port to listen on").Default("1234").Short('p').String()
+	dir          = kingpin.Arg("dir", "The directory to serve").String()
+	port         = kingpin.Flag("port", "The port to listen on").Default("1234").Short('p').String()
+	routesPath   = kingpin.Flag("routes", "A routes.yaml file mapping routes to CSV/schema sources").String()
+	envelopeFlag = kingpin.Flag("envelope", "Response envelope: bare (raw array/object) or data ({\"data\": ..., \"meta\": ...})").Default("bare").Enum("bare", "data")
+	writable     = kingpin.Flag("writable", "Allow POST/PUT/DELETE to overwrite the served CSV files (directory mode only; routes.yaml controls this per-route instead)").Bool()
 )
 
-func main() {
-	kingpin.Parse()
-	fileNames, err := dirFileNames(*dir)
+// loadDataDir mounts every .json file found directly in dir, the
+// original (and still simplest) way to start serve-csv. A flat schema
+// is served from its paired .csv file and is read-only unless writable
+// is set, since a flat schema has no per-route config to opt a route
+// in individually. A variant-list file (see readVariants) names its
+// own CSVs and takes each variant's persistence from that variant's
+// "update" entry; writable does not apply to it.
+func loadDataDir(dir string, writable bool, routes *DataRoutes) error {
+	fileNames, err := dirFileNames(dir)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	dataPaths, err := matchDataPaths(*dir, fileNames)
+	dataPaths, err := matchDataPaths(dir, fileNames)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	routes := NewDataRoutes()
 	for _, path := range dataPaths {
-		raw, err := readSchema(path.json)
+		raw, err := readSchemaBytes(path.json)
 		if err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("error reading schema %s: %v", path.json, err)
+		}
+		if looksLikeVariantList(raw) {
+			variants, err := readVariants(raw, path.json)
+			if err != nil {
+				return fmt.Errorf("route %q: %v", path.route, err)
+			}
+			routes.InsertVariants(path.route, variants)
+			continue
 		}
-		schema, err := raw.validate()
+		if path.csv == "" {
+			return fmt.Errorf("%s: a flat schema requires a paired %s.csv file", path.json, path.route)
+		}
+		schema, err := schemaFromBytes(raw, path.json)
 		if err != nil {
-			log.Fatal(fmt.Sprintf("Error validating %s: %v", path.json, err))
+			return fmt.Errorf("error reading schema %s: %v", path.json, err)
 		}
-		data, err := readCSVData(path.csv, schema)
+		data, err := readCSVData(path.csv, schema, 0)
 		if err != nil {
+			return err
+		}
+		var updater Updater
+		if writable {
+			updater = fileUpdater{path: path.csv}
+		}
+		routes.Insert(path.route, *data, updater)
+	}
+	return nil
+}
+
+func main() {
+	kingpin.Parse()
+	routes := NewDataRoutes()
+	switch {
+	case *routesPath != "":
+		if err := loadRoutesConfig(*routesPath, routes); err != nil {
+			log.Fatal(err)
+		}
+	case *dir != "":
+		if err := loadDataDir(*dir, *writable, routes); err != nil {
 			log.Fatal(err)
 		}
-		routes.Insert(path.route, *data)
+	default:
+		log.Fatal("either a dir argument or --routes must be given")
 	}
+	mode := envelopeMode(*envelopeFlag)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		// this removes the first /
@@ -283,20 +410,73 @@ func main() {
 		splits := strings.Split(route, "/")
 		lastPart := splits[len(splits)-1]
 		index, indexErr := strconv.ParseInt(lastPart, 10, 32)
-		var data []byte
+		hasIndex := indexErr == nil
+		baseRoute := route
+		if hasIndex {
+			baseRoute = route[:len(route)-len(lastPart)-1]
+		}
+
+		var payload interface{}
+		var meta *queryMeta
 		var err error
-		if indexErr != nil {
-			data, err = routes.GetAll(route)
-		} else {
-			route := route[:len(route)-len(lastPart)-1]
-			data, err = routes.GetNth(route, int(index))
+		switch r.Method {
+		case http.MethodGet:
+			queryValues := r.URL.Query()
+			matchPayload := queryPayload(queryValues)
+			if hasIndex {
+				payload, err = routes.GetNth(baseRoute, int(index), matchPayload)
+			} else {
+				var q *rowQuery
+				q, err = parseRowQuery(queryValues)
+				if err == nil {
+					var rows []map[string]interface{}
+					var m queryMeta
+					rows, m, err = routes.GetAll(route, q, matchPayload)
+					payload, meta = rows, &m
+				}
+			}
+		case http.MethodPost:
+			if hasIndex {
+				err = fmt.Errorf("POST is only supported on a route, not a specific row")
+			} else {
+				var body []byte
+				body, err = ioutil.ReadAll(r.Body)
+				if err == nil {
+					payload, err = routes.Append(route, body)
+				}
+			}
+		case http.MethodPut:
+			if !hasIndex {
+				err = fmt.Errorf("PUT requires a row index")
+			} else {
+				var body []byte
+				body, err = ioutil.ReadAll(r.Body)
+				if err == nil {
+					payload, err = routes.Replace(baseRoute, int(index), body)
+				}
+			}
+		case http.MethodDelete:
+			if !hasIndex {
+				err = fmt.Errorf("DELETE requires a row index")
+			} else {
+				err = routes.Delete(baseRoute, int(index), queryPayload(r.URL.Query()))
+				if err == nil {
+					payload = struct{}{}
+				}
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
 		}
 		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprintf(w, `{"error": "%v"}`, err)
+			status := http.StatusNotFound
+			if _, ok := err.(*queryError); ok {
+				status = http.StatusBadRequest
+			}
+			writeError(w, mode, status, route, err)
 			return
 		}
-		w.Write(data)
+		writeSuccess(w, mode, payload, meta)
 	})
 	log.Printf("Listening on port %s", *port)
 	log.Fatal(http.ListenAndServe(":"+*port, nil))
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// queryOp is a comparison operator applied to a field via a
+// "field(__op)?=value" query parameter.
+type queryOp int
+
+const (
+	opEq queryOp = iota
+	opGt
+	opLt
+	opContains
+)
+
+// filter is a single parsed filter parameter.
+type filter struct {
+	field string
+	op    queryOp
+	value string
+}
+
+// sortKey is one comma-separated entry of a "?sort=" parameter: a
+// field name, optionally prefixed with "-" for descending order.
+type sortKey struct {
+	field      string
+	descending bool
+}
+
+// defaultLimit caps the page size when neither ?limit nor ?per_page
+// is given, so a route with a huge CSV can't be dumped in one request
+// by accident.
+const defaultLimit = 100
+
+// rowQuery holds the filter/sort/pagination parameters parsed out of
+// a request's URL query.
+type rowQuery struct {
+	filters []filter
+	sorts   []sortKey
+	limit   int
+	offset  int
+}
+
+// queryMeta describes the page of rows actually returned, so clients
+// can page through a route without loading everything at once.
+type queryMeta struct {
+	Total  int  `json:"total"`
+	Limit  int  `json:"limit"`
+	Offset int  `json:"offset"`
+	Next   *int `json:"next,omitempty"`
+}
+
+// queryError marks a problem with the request itself (an unknown
+// field, a bad operator, a non-numeric limit, an invalid or
+// schema-violating body, a write to a read-only route, no matching
+// response variant), as opposed to the route simply not existing.
+type queryError struct {
+	msg string
+}
+
+func (e *queryError) Error() string { return e.msg }
+
+// parseRowQuery parses filter/sort/pagination parameters out of a
+// request's URL query string.
+func parseRowQuery(values url.Values) (*rowQuery, error) {
+	q := &rowQuery{limit: defaultLimit}
+	if v := values.Get("per_page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, &queryError{fmt.Sprintf("per_page must be an integer: %v", err)}
+		}
+		q.limit = n
+	}
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, &queryError{fmt.Sprintf("limit must be an integer: %v", err)}
+		}
+		q.limit = n
+	}
+	if v := values.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, &queryError{fmt.Sprintf("offset must be an integer: %v", err)}
+		}
+		q.offset = n
+	}
+	if v := values.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, &queryError{fmt.Sprintf("page must be an integer: %v", err)}
+		}
+		if n > 1 {
+			q.offset = (n - 1) * q.limit
+		}
+	}
+	if v := values.Get("sort"); v != "" {
+		for _, part := range strings.Split(v, ",") {
+			descending := strings.HasPrefix(part, "-")
+			q.sorts = append(q.sorts, sortKey{strings.TrimPrefix(part, "-"), descending})
+		}
+	}
+	reserved := map[string]bool{"sort": true, "limit": true, "offset": true, "page": true, "per_page": true}
+	for key, vals := range values {
+		if reserved[key] {
+			continue
+		}
+		field, op := splitFieldOp(key)
+		for _, value := range vals {
+			q.filters = append(q.filters, filter{field, op, value})
+		}
+	}
+	return q, nil
+}
+
+// splitFieldOp splits a query key like "age__gt" into its field name
+// and operator, defaulting to an exact-match opEq.
+func splitFieldOp(key string) (string, queryOp) {
+	for suffix, op := range map[string]queryOp{"__gt": opGt, "__lt": opLt, "__contains": opContains} {
+		if strings.HasSuffix(key, suffix) {
+			return key[:len(key)-len(suffix)], op
+		}
+	}
+	return key, opEq
+}
+
+// applyQuery filters, sorts, and paginates data's rows according to
+// q, validating that every referenced field exists in the schema and
+// that comparison operators are only used against compatible types.
+func (data *CSVData) applyQuery(q *rowQuery) ([]map[string]interface{}, queryMeta, error) {
+	for _, f := range q.filters {
+		idx, ok := data.Schema.fieldIndex(f.field)
+		if !ok {
+			return nil, queryMeta{}, &queryError{fmt.Sprintf("unknown field %q", f.field)}
+		}
+		typ := data.Schema.Types[idx]
+		switch f.op {
+		case opGt, opLt:
+			if typ != TypeInteger && typ != TypeNumber && typ != TypeDateTime {
+				return nil, queryMeta{}, &queryError{fmt.Sprintf("field %q does not support __gt/__lt", f.field)}
+			}
+			if _, err := parseLike(zeroValueForType(typ), f.value); err != nil {
+				return nil, queryMeta{}, &queryError{fmt.Sprintf("field %q: %v", f.field, err)}
+			}
+		case opContains:
+			if typ != TypeString {
+				return nil, queryMeta{}, &queryError{fmt.Sprintf("field %q does not support __contains", f.field)}
+			}
+		}
+	}
+	for _, s := range q.sorts {
+		if _, ok := data.Schema.fieldIndex(s.field); !ok {
+			return nil, queryMeta{}, &queryError{fmt.Sprintf("unknown field %q", s.field)}
+		}
+	}
+
+	rows := make([]map[string]interface{}, 0, len(data.rows))
+	for _, row := range data.rows {
+		if rowMatches(row, q.filters) {
+			rows = append(rows, row)
+		}
+	}
+	if len(q.sorts) > 0 {
+		sort.SliceStable(rows, func(i, j int) bool {
+			for _, s := range q.sorts {
+				cmp := compareValues(rows[i][s.field], rows[j][s.field])
+				if cmp == 0 {
+					continue
+				}
+				if s.descending {
+					return cmp > 0
+				}
+				return cmp < 0
+			}
+			return false
+		})
+	}
+
+	total := len(rows)
+	offset := q.offset
+	if offset > total {
+		offset = total
+	}
+	limit := q.limit
+	end := offset + limit
+	if limit <= 0 || end > total {
+		end = total
+	}
+	meta := queryMeta{Total: total, Limit: limit, Offset: offset}
+	if end < total {
+		next := end
+		meta.Next = &next
+	}
+	return rows[offset:end], meta, nil
+}
+
+func rowMatches(row map[string]interface{}, filters []filter) bool {
+	for _, f := range filters {
+		val, ok := row[f.field]
+		if !ok {
+			return false
+		}
+		switch f.op {
+		case opEq:
+			if formatFieldValue(val) != f.value {
+				return false
+			}
+		case opGt:
+			other, err := parseLike(val, f.value)
+			if err != nil || compareValues(val, other) <= 0 {
+				return false
+			}
+		case opLt:
+			other, err := parseLike(val, f.value)
+			if err != nil || compareValues(val, other) >= 0 {
+				return false
+			}
+		case opContains:
+			str, ok := val.(string)
+			if !ok || !strings.Contains(str, f.value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parseLike parses raw into the same dynamic type as sample, so the
+// two can be compared with compareValues. It errors if raw isn't
+// valid for that type, rather than silently falling back to a zero
+// value that would never legitimately match.
+func parseLike(sample interface{}, raw string) (interface{}, error) {
+	switch sample.(type) {
+	case int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected an integer, got %q", raw)
+		}
+		return n, nil
+	case float64:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected a number, got %q", raw)
+		}
+		return n, nil
+	case time.Time:
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return nil, fmt.Errorf("expected an RFC3339 timestamp, got %q", raw)
+		}
+		return t, nil
+	default:
+		return raw, nil
+	}
+}
+
+// zeroValueForType returns a value of the Go type typ coerces to, for
+// use as parseLike's sample when no row is at hand yet (up-front
+// filter validation).
+func zeroValueForType(typ FieldType) interface{} {
+	switch typ {
+	case TypeInteger:
+		return int64(0)
+	case TypeNumber:
+		return float64(0)
+	case TypeDateTime:
+		return time.Time{}
+	default:
+		return ""
+	}
+}
+
+// compareValues orders two row values of the same underlying type,
+// returning a negative, zero, or positive number as with strings.Compare.
+func compareValues(a, b interface{}) int {
+	switch av := a.(type) {
+	case int64:
+		bv, _ := b.(int64)
+		switch {
+		case av < bv:
+			return -1
+		case av > bv:
+			return 1
+		default:
+			return 0
+		}
+	case float64:
+		bv, _ := b.(float64)
+		switch {
+		case av < bv:
+			return -1
+		case av > bv:
+			return 1
+		default:
+			return 0
+		}
+	case time.Time:
+		bv, _ := b.(time.Time)
+		switch {
+		case av.Before(bv):
+			return -1
+		case av.After(bv):
+			return 1
+		default:
+			return 0
+		}
+	case bool:
+		bv, _ := b.(bool)
+		switch {
+		case av == bv:
+			return 0
+		case !av && bv:
+			return -1
+		default:
+			return 1
+		}
+	case string:
+		bv, _ := b.(string)
+		return strings.Compare(av, bv)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// refreshInterval is how often an http(s)-backed route is checked for
+// changes.
+const refreshInterval = 30 * time.Second
+
+// watchForUpdates polls an http(s) CSV source on a timer, re-parsing
+// and swapping its CSVData into routes whenever the server reports
+// the resource has changed. The initial load records no ETag or
+// Last-Modified, so the first check always re-fetches and reloads.
+// Non-http(s) sources are left alone, since there's no cheap way to
+// ask a file or stdin whether it changed.
+func watchForUpdates(route, csvURL string, schema *Schema, delimiter rune, routes *DataRoutes) {
+	scheme, err := sourceScheme(csvURL)
+	if err != nil || (scheme != "http" && scheme != "https") {
+		return
+	}
+	source := httpSource{}
+	var etag, lastModified string
+	for range time.Tick(refreshInterval) {
+		body, newETag, newLastModified, unmodified, err := source.OpenIfModified(csvURL, etag, lastModified)
+		if err != nil {
+			log.Printf("refreshing route %q from %s: %v", route, csvURL, err)
+			continue
+		}
+		if unmodified {
+			continue
+		}
+		data, err := parseCSVData(body, schema, delimiter, csvURL)
+		body.Close()
+		if err != nil {
+			log.Printf("refreshing route %q from %s: %v", route, csvURL, err)
+			continue
+		}
+		etag, lastModified = newETag, newLastModified
+		routes.Swap(route, *data)
+		log.Printf("reloaded route %q from %s", route, csvURL)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// readSchemaBytes fetches the raw bytes of a schema document from any
+// registered Source (a local path, an http(s) URL, or stdin://).
+func readSchemaBytes(path string) ([]byte, error) {
+	reader, err := openSource(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// FieldType represents the coercion applied to a raw CSV cell before
+// the assembled row is validated against the JSON Schema document.
+type FieldType int
+
+const (
+	// TypeString leaves the cell as a plain string
+	TypeString FieldType = iota
+	// TypeInteger parses the cell as an int64
+	TypeInteger
+	// TypeNumber parses the cell as a float64
+	TypeNumber
+	// TypeBoolean parses the cell as a bool
+	TypeBoolean
+	// TypeDateTime parses the cell as an RFC3339 time.Time
+	TypeDateTime
+)
+
+// parseFieldType maps a JSON Schema "type" (and, for strings, "format")
+// to the FieldType used to coerce a CSV cell.
+func parseFieldType(typ, format string) (FieldType, error) {
+	switch typ {
+	case "integer":
+		return TypeInteger, nil
+	case "number":
+		return TypeNumber, nil
+	case "boolean":
+		return TypeBoolean, nil
+	case "string":
+		if format == "date-time" {
+			return TypeDateTime, nil
+		}
+		return TypeString, nil
+	default:
+		return 0, fmt.Errorf("unsupported type %q", typ)
+	}
+}
+
+// propertyType holds a property's "type" keyword, which JSON Schema
+// allows to be either a single string ("integer") or an array of
+// strings ("["string", "null"]", the idiom for a nullable field). We
+// don't support nullable fields yet, since a CSV cell has no way to
+// distinguish "null" from an empty string; unmarshaling records which
+// form was used so schemaFromBytes can fail with a clear error
+// instead of a raw json.Unmarshal type mismatch.
+type propertyType struct {
+	single     string
+	alternates []string
+}
+
+func (t *propertyType) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '[' {
+		return json.Unmarshal(data, &t.alternates)
+	}
+	return json.Unmarshal(data, &t.single)
+}
+
+// Schema holds the compiled JSON Schema document used to validate a
+// CSV file's rows, along with the field order and coercion needed to
+// turn a raw CSV record into the map[string]interface{} the schema
+// expects.
+//
+// The CSV files we serve have no header row, so the column order is
+// taken from the schema's own "required" array: it must list every
+// field, in the order its values appear in the CSV.
+type Schema struct {
+	Fields   []string
+	Types    []FieldType
+	compiled *gojsonschema.Schema
+}
+
+// readSchema loads and compiles a JSON Schema (draft-07) document.
+// This can fail because of IO, because the document isn't a valid
+// schema, or because it doesn't declare a usable "required" field
+// order.
+func readSchema(path string) (*Schema, error) {
+	raw, err := readSchemaBytes(path)
+	if err != nil {
+		return nil, err
+	}
+	return schemaFromBytes(raw, path)
+}
+
+// schemaFromBytes compiles a JSON Schema document already in memory.
+// It backs readSchema (which reads a whole file) as well as the
+// response_schema of a route's individual response variants (see
+// readVariants), which live embedded in a larger JSON document.
+func schemaFromBytes(raw []byte, label string) (*Schema, error) {
+	compiled, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid JSON schema: %v", label, err)
+	}
+	var doc struct {
+		Properties map[string]struct {
+			Type   propertyType `json:"type"`
+			Format string       `json:"format"`
+		} `json:"properties"`
+		Required []string `json:"required"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", label, err)
+	}
+	if len(doc.Required) == 0 {
+		return nil, fmt.Errorf("%s: schema must list every field in \"required\", in CSV column order", label)
+	}
+	fields := make([]string, 0, len(doc.Required))
+	types := make([]FieldType, 0, len(doc.Required))
+	for _, field := range doc.Required {
+		prop, ok := doc.Properties[field]
+		if !ok {
+			return nil, fmt.Errorf("%s: required field %q has no matching properties entry", label, field)
+		}
+		if prop.Type.alternates != nil {
+			return nil, fmt.Errorf("%s: field %q: nullable types (%v) aren't supported, since a CSV cell can't distinguish null from an empty string", label, field, prop.Type.alternates)
+		}
+		typ, err := parseFieldType(prop.Type.single, prop.Format)
+		if err != nil {
+			return nil, fmt.Errorf("%s: field %q: %v", label, field, err)
+		}
+		fields = append(fields, field)
+		types = append(types, typ)
+	}
+	return &Schema{Fields: fields, Types: types, compiled: compiled}, nil
+}
+
+// fieldIndex returns the position of a field in schema.Fields/Types,
+// used to validate and type-check query parameters against the schema.
+func (schema *Schema) fieldIndex(field string) (int, bool) {
+	for i, f := range schema.Fields {
+		if f == field {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// coerceRow converts a raw CSV record into a map[string]interface{}
+// keyed by field name, then validates it against the compiled JSON
+// Schema document. The returned error identifies which field and
+// which rule failed.
+func (schema *Schema) coerceRow(record []string) (map[string]interface{}, error) {
+	if len(record) != len(schema.Fields) {
+		return nil, fmt.Errorf("bad record length, expected %d, got %d", len(schema.Fields), len(record))
+	}
+	row := make(map[string]interface{}, len(schema.Fields))
+	for i, field := range schema.Fields {
+		cell := record[i]
+		switch schema.Types[i] {
+		case TypeInteger:
+			num, err := strconv.ParseInt(cell, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("field %q: %v", field, err)
+			}
+			row[field] = num
+		case TypeNumber:
+			num, err := strconv.ParseFloat(cell, 64)
+			if err != nil {
+				return nil, fmt.Errorf("field %q: %v", field, err)
+			}
+			row[field] = num
+		case TypeBoolean:
+			b, err := strconv.ParseBool(cell)
+			if err != nil {
+				return nil, fmt.Errorf("field %q: %v", field, err)
+			}
+			row[field] = b
+		case TypeDateTime:
+			t, err := time.Parse(time.RFC3339, cell)
+			if err != nil {
+				return nil, fmt.Errorf("field %q: %v", field, err)
+			}
+			row[field] = t
+		default:
+			row[field] = cell
+		}
+	}
+	if err := schema.validateRow(row); err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+// validateRow runs an already-coerced row through the compiled JSON
+// Schema document, returning an error naming the field and rule that
+// failed.
+func (schema *Schema) validateRow(row map[string]interface{}) error {
+	result, err := schema.compiled.Validate(gojsonschema.NewGoLoader(row))
+	if err != nil {
+		return fmt.Errorf("validating row against schema: %v", err)
+	}
+	if !result.Valid() {
+		reasons := make([]string, 0, len(result.Errors()))
+		for _, re := range result.Errors() {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", re.Field(), re.Description()))
+		}
+		return fmt.Errorf("schema violation: %s", strings.Join(reasons, "; "))
+	}
+	return nil
+}
+
+// coerceRequestRow decodes and validates a JSON request body as a
+// single row, applying the same type coercion readCSVData applies to
+// CSV cells so a row written via the API is indistinguishable from
+// one loaded at startup.
+func (schema *Schema) coerceRequestRow(body []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var raw map[string]interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("invalid JSON body: %v", err)
+	}
+	row := make(map[string]interface{}, len(schema.Fields))
+	for i, field := range schema.Fields {
+		val, ok := raw[field]
+		if !ok {
+			return nil, fmt.Errorf("missing field %q", field)
+		}
+		coerced, err := coerceJSONValue(schema.Types[i], val)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %v", field, err)
+		}
+		row[field] = coerced
+	}
+	if err := schema.validateRow(row); err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+// coerceJSONValue converts a decoded JSON value (a json.Number for
+// integer/number fields, since the decoder runs with UseNumber) into
+// the same Go type coerceRow would produce from a CSV cell.
+func coerceJSONValue(typ FieldType, val interface{}) (interface{}, error) {
+	switch typ {
+	case TypeInteger:
+		num, ok := val.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("expected an integer")
+		}
+		return num.Int64()
+	case TypeNumber:
+		num, ok := val.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("expected a number")
+		}
+		return num.Float64()
+	case TypeBoolean:
+		b, ok := val.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expected a boolean")
+		}
+		return b, nil
+	case TypeDateTime:
+		str, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected an RFC3339 timestamp")
+		}
+		return time.Parse(time.RFC3339, str)
+	default:
+		str, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a string")
+		}
+		return str, nil
+	}
+}
+
+// toCSVRecords serializes rows back into plain CSV records, in schema
+// field order, so an Updater can persist a write back to disk.
+func (schema *Schema) toCSVRecords(rows []map[string]interface{}) [][]string {
+	records := make([][]string, 0, len(rows))
+	for _, row := range rows {
+		record := make([]string, len(schema.Fields))
+		for i, field := range schema.Fields {
+			record[i] = formatFieldValue(row[field])
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// formatFieldValue renders a coerced row value back to its CSV cell
+// form, the inverse of coerceRow's per-field switch.
+func formatFieldValue(val interface{}) string {
+	switch v := val.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case string:
+		return v
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
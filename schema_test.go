@@ -0,0 +1,180 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFieldType(t *testing.T) {
+	cases := []struct {
+		name    string
+		typ     string
+		format  string
+		want    FieldType
+		wantErr bool
+	}{
+		{"integer", "integer", "", TypeInteger, false},
+		{"number", "number", "", TypeNumber, false},
+		{"boolean", "boolean", "", TypeBoolean, false},
+		{"plain string", "string", "", TypeString, false},
+		{"date-time string", "string", "date-time", TypeDateTime, false},
+		{"unsupported type", "object", "", 0, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parseFieldType(c.typ, c.format)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("parseFieldType(%q, %q) = %v, nil; want error", c.typ, c.format, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseFieldType(%q, %q) returned unexpected error: %v", c.typ, c.format, err)
+			}
+			if got != c.want {
+				t.Fatalf("parseFieldType(%q, %q) = %v, want %v", c.typ, c.format, got, c.want)
+			}
+		})
+	}
+}
+
+const testUserSchema = `{
+  "type": "object",
+  "properties": {
+    "id": {"type": "integer"},
+    "name": {"type": "string"},
+    "joined": {"type": "string", "format": "date-time"}
+  },
+  "required": ["id", "name", "joined"]
+}`
+
+func TestSchemaFromBytes(t *testing.T) {
+	schema, err := schemaFromBytes([]byte(testUserSchema), "test.json")
+	if err != nil {
+		t.Fatalf("schemaFromBytes: %v", err)
+	}
+	wantFields := []string{"id", "name", "joined"}
+	if len(schema.Fields) != len(wantFields) {
+		t.Fatalf("Fields = %v, want %v", schema.Fields, wantFields)
+	}
+	for i, f := range wantFields {
+		if schema.Fields[i] != f {
+			t.Errorf("Fields[%d] = %q, want %q", i, schema.Fields[i], f)
+		}
+	}
+}
+
+func TestSchemaFromBytes_MissingRequired(t *testing.T) {
+	_, err := schemaFromBytes([]byte(`{"properties": {}}`), "test.json")
+	if err == nil {
+		t.Fatal("expected an error for a schema with no \"required\" field order")
+	}
+}
+
+func TestSchemaFromBytes_NullableTypeRejected(t *testing.T) {
+	raw := `{
+	  "properties": {
+	    "id": {"type": "integer"},
+	    "nickname": {"type": ["string", "null"]}
+	  },
+	  "required": ["id", "nickname"]
+	}`
+	_, err := schemaFromBytes([]byte(raw), "test.json")
+	if err == nil {
+		t.Fatal("expected an error for a nullable (type: [x, null]) field")
+	}
+	if !strings.Contains(err.Error(), "nullable") {
+		t.Errorf("error %q doesn't mention nullable types aren't supported", err)
+	}
+}
+
+func TestCoerceRow(t *testing.T) {
+	schema, err := schemaFromBytes([]byte(testUserSchema), "test.json")
+	if err != nil {
+		t.Fatalf("schemaFromBytes: %v", err)
+	}
+	row, err := schema.coerceRow([]string{"1", "Alice", "2021-01-02T15:04:05Z"})
+	if err != nil {
+		t.Fatalf("coerceRow: %v", err)
+	}
+	if row["id"] != int64(1) {
+		t.Errorf("id = %v, want int64(1)", row["id"])
+	}
+	if row["name"] != "Alice" {
+		t.Errorf("name = %v, want Alice", row["name"])
+	}
+	wantTime, _ := time.Parse(time.RFC3339, "2021-01-02T15:04:05Z")
+	if row["joined"] != wantTime {
+		t.Errorf("joined = %v, want %v", row["joined"], wantTime)
+	}
+}
+
+func TestCoerceRow_BadCell(t *testing.T) {
+	schema, err := schemaFromBytes([]byte(testUserSchema), "test.json")
+	if err != nil {
+		t.Fatalf("schemaFromBytes: %v", err)
+	}
+	if _, err := schema.coerceRow([]string{"not-an-int", "Alice", "2021-01-02T15:04:05Z"}); err == nil {
+		t.Fatal("expected an error coercing a non-integer id cell")
+	}
+}
+
+func TestCoerceRow_WrongLength(t *testing.T) {
+	schema, err := schemaFromBytes([]byte(testUserSchema), "test.json")
+	if err != nil {
+		t.Fatalf("schemaFromBytes: %v", err)
+	}
+	if _, err := schema.coerceRow([]string{"1", "Alice"}); err == nil {
+		t.Fatal("expected an error for a record with too few cells")
+	}
+}
+
+func TestCoerceRequestRow(t *testing.T) {
+	schema, err := schemaFromBytes([]byte(testUserSchema), "test.json")
+	if err != nil {
+		t.Fatalf("schemaFromBytes: %v", err)
+	}
+	body := []byte(`{"id": 2, "name": "Bob", "joined": "2021-06-01T00:00:00Z"}`)
+	row, err := schema.coerceRequestRow(body)
+	if err != nil {
+		t.Fatalf("coerceRequestRow: %v", err)
+	}
+	if row["id"] != int64(2) {
+		t.Errorf("id = %v, want int64(2)", row["id"])
+	}
+}
+
+func TestCoerceRequestRow_MissingField(t *testing.T) {
+	schema, err := schemaFromBytes([]byte(testUserSchema), "test.json")
+	if err != nil {
+		t.Fatalf("schemaFromBytes: %v", err)
+	}
+	body := []byte(`{"id": 2, "name": "Bob"}`)
+	if _, err := schema.coerceRequestRow(body); err == nil {
+		t.Fatal("expected an error for a request body missing a required field")
+	}
+}
+
+func TestFormatFieldValue(t *testing.T) {
+	ts, _ := time.Parse(time.RFC3339, "2021-01-02T15:04:05Z")
+	cases := []struct {
+		name string
+		val  interface{}
+		want string
+	}{
+		{"int64", int64(42), "42"},
+		{"float64", float64(3.5), "3.5"},
+		{"bool", true, "true"},
+		{"time.Time", ts, "2021-01-02T15:04:05Z"},
+		{"string", "hi", "hi"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := formatFieldValue(c.val); got != c.want {
+				t.Errorf("formatFieldValue(%v) = %q, want %q", c.val, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// Source opens the bytes behind a CSV or schema URL. Schemes are
+// registered in sourcesByScheme, so a data source is no longer limited
+// to files living in a local directory.
+type Source interface {
+	Open(rawURL string) (io.ReadCloser, error)
+}
+
+var sourcesByScheme = map[string]Source{
+	"file":  fileSource{},
+	"http":  httpSource{},
+	"https": httpSource{},
+	"stdin": stdinSource{},
+}
+
+// openSource dispatches a URL to the Source registered for its scheme.
+// Paths with no scheme, such as the ones matchDataPaths builds up for
+// a local directory, are treated as file:// for backwards compatibility.
+func openSource(rawURL string) (io.ReadCloser, error) {
+	scheme, err := sourceScheme(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	source, ok := sourcesByScheme[scheme]
+	if !ok {
+		return nil, fmt.Errorf("%s: no source registered for scheme %q", rawURL, scheme)
+	}
+	return source.Open(rawURL)
+}
+
+func sourceScheme(rawURL string) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", rawURL, err)
+	}
+	if parsed.Scheme == "" {
+		return "file", nil
+	}
+	return parsed.Scheme, nil
+}
+
+// fileSource reads from the local filesystem, stripping a file://
+// prefix if one was given.
+type fileSource struct{}
+
+func (fileSource) Open(rawURL string) (io.ReadCloser, error) {
+	path := rawURL
+	if parsed, err := url.Parse(rawURL); err == nil && parsed.Scheme == "file" {
+		path = parsed.Path
+	}
+	return os.Open(path)
+}
+
+// stdinSource reads all of what remains of os.Stdin into memory each
+// time it's opened, so every open after the first sees an already
+// drained stdin. Since a process can only consume stdin once, callers
+// should only use the stdin:// scheme for a single input.
+type stdinSource struct{}
+
+func (stdinSource) Open(rawURL string) (io.ReadCloser, error) {
+	raw, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(raw)), nil
+}
+
+// httpSource fetches a URL over http or https.
+type httpSource struct{}
+
+func (httpSource) Open(rawURL string) (io.ReadCloser, error) {
+	resp, err := http.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: unexpected status %s", rawURL, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// OpenIfModified re-fetches rawURL, sending the ETag/Last-Modified
+// values from a previous fetch so the server can reply 304 Not
+// Modified instead of resending the body. unmodified is true whenever
+// that happens, in which case body is nil and the caller should keep
+// using what it already has.
+func (httpSource) OpenIfModified(rawURL, etag, lastModified string) (body io.ReadCloser, newETag, newLastModified string, unmodified bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, "", "", false, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", "", false, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return nil, etag, lastModified, true, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, "", "", false, fmt.Errorf("%s: unexpected status %s", rawURL, resp.Status)
+	}
+	return resp.Body, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), false, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Updater persists a route's data after a write request has been
+// validated and applied in memory. Implementations mirror the
+// file/exec/stdout updaters used by similar mock-server tools.
+type Updater interface {
+	Write(data *CSVData) error
+}
+
+// UpdaterConfig selects and configures a route's persistence backend
+// in routes.yaml. An empty Type makes the route read-only.
+type UpdaterConfig struct {
+	Type    string `yaml:"type"`
+	Command string `yaml:"command"`
+}
+
+// buildUpdater constructs the Updater described by config.
+func buildUpdater(config UpdaterConfig, csvPath string) (Updater, error) {
+	switch config.Type {
+	case "", "none":
+		return nil, nil
+	case "file":
+		return fileUpdater{path: csvPath}, nil
+	case "stdout":
+		return stdoutUpdater{}, nil
+	case "exec":
+		if config.Command == "" {
+			return nil, fmt.Errorf("exec updater requires a command")
+		}
+		return execUpdater{command: config.Command}, nil
+	default:
+		return nil, fmt.Errorf("unknown updater type %q", config.Type)
+	}
+}
+
+// fileUpdater rewrites a CSV file in place, atomically via a
+// temp-file-plus-rename so readers never observe a half-written file.
+type fileUpdater struct {
+	path string
+}
+
+func (u fileUpdater) Write(data *CSVData) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(u.path), ".serve-csv-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := writeCSV(tmp, data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), u.path)
+}
+
+// stdoutUpdater emits the new CSV to stdout, for piping into another
+// process instead of writing a file.
+type stdoutUpdater struct{}
+
+func (stdoutUpdater) Write(data *CSVData) error {
+	return writeCSV(os.Stdout, data)
+}
+
+// execUpdater spawns a user-supplied command and pipes the new CSV to
+// its stdin, so a route's writes can trigger something like
+// `git commit` or pushing the file to S3.
+type execUpdater struct {
+	command string
+}
+
+func (u execUpdater) Write(data *CSVData) error {
+	cmd := exec.Command("sh", "-c", u.command)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	writeErr := writeCSV(stdin, data)
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("exec updater %q: %v", u.command, err)
+	}
+	return writeErr
+}
+
+// writeCSV renders data's rows as CSV into w.
+func writeCSV(w io.Writer, data *CSVData) error {
+	writer := csv.NewWriter(w)
+	if err := writer.WriteAll(data.Schema.toCSVRecords(data.rows)); err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
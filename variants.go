@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// variantSpec is one entry of a route's JSON file when it declares
+// several response variants instead of a single flat schema,
+// borrowed from killgrave's imposter model: the first variant whose
+// match schema accepts the incoming request is used to answer it.
+type variantSpec struct {
+	Match          json.RawMessage `json:"match"`
+	CSV            string          `json:"csv"`
+	ResponseSchema json.RawMessage `json:"response_schema"`
+	Update         UpdaterConfig   `json:"update"`
+}
+
+// routeVariant pairs one CSV dataset with the match schema that
+// selects it. A nil match makes a variant the default: used whenever
+// no other variant matches, and the only variant for a route whose
+// JSON file is an ordinary flat schema.
+type routeVariant struct {
+	match   *gojsonschema.Schema
+	data    CSVData
+	updater Updater
+}
+
+// persist writes v's current data out through its Updater, if it has
+// one.
+func (v *routeVariant) persist() error {
+	if v.updater == nil {
+		return nil
+	}
+	return v.updater.Write(&v.data)
+}
+
+// looksLikeVariantList reports whether a route's JSON file is an
+// array of variants rather than a single flat schema object.
+func looksLikeVariantList(raw []byte) bool {
+	for _, b := range raw {
+		switch b {
+		case ' ', '\t', '\n', '\r':
+			continue
+		case '[':
+			return true
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// readVariants parses a route's JSON file as a list of variants, each
+// naming its own CSV and response schema. A variant's "csv" path is
+// resolved relative to base, the path or URL of the route's own JSON
+// file, unless it's already absolute or carries its own scheme.
+func readVariants(raw []byte, base string) ([]routeVariant, error) {
+	var specs []variantSpec
+	if err := json.Unmarshal(raw, &specs); err != nil {
+		return nil, fmt.Errorf("invalid variant list: %v", err)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("variant list must declare at least one variant")
+	}
+	variants := make([]routeVariant, 0, len(specs))
+	for i, spec := range specs {
+		var match *gojsonschema.Schema
+		if len(spec.Match) > 0 {
+			compiled, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(spec.Match))
+			if err != nil {
+				return nil, fmt.Errorf("variant %d: invalid match schema: %v", i, err)
+			}
+			match = compiled
+		}
+		schema, err := schemaFromBytes(spec.ResponseSchema, fmt.Sprintf("variant %d response_schema", i))
+		if err != nil {
+			return nil, err
+		}
+		csvPath := resolveRelative(base, spec.CSV)
+		data, err := readCSVData(csvPath, schema, 0)
+		if err != nil {
+			return nil, fmt.Errorf("variant %d: %v", i, err)
+		}
+		updater, err := buildUpdater(spec.Update, csvPath)
+		if err != nil {
+			return nil, fmt.Errorf("variant %d: %v", i, err)
+		}
+		variants = append(variants, routeVariant{match: match, data: *data, updater: updater})
+	}
+	return variants, nil
+}
+
+// resolveRelative joins ref against the directory of base, unless ref
+// is already an absolute path or carries its own URL scheme. When base
+// is itself an http(s) URL, the join happens through net/url rather
+// than filepath, since filepath.Join would clean away the "//" after
+// the scheme.
+func resolveRelative(base, ref string) string {
+	if strings.Contains(ref, "://") || filepath.IsAbs(ref) {
+		return ref
+	}
+	if baseURL, err := url.Parse(base); err == nil && baseURL.Scheme != "" {
+		refURL, err := baseURL.Parse(ref)
+		if err == nil {
+			return refURL.String()
+		}
+	}
+	return filepath.Join(filepath.Dir(base), ref)
+}
+
+// queryPayload converts URL query values into the flat
+// map[string]interface{} a "match" schema can validate against,
+// coercing the first value of each parameter to the most specific
+// type it parses as (see coerceQueryValue) so a match schema can
+// declare "type": "integer"/"boolean" for a query parameter and not
+// just "string".
+func queryPayload(values url.Values) map[string]interface{} {
+	payload := make(map[string]interface{}, len(values))
+	for key, vals := range values {
+		if len(vals) > 0 {
+			payload[key] = coerceQueryValue(vals[0])
+		}
+	}
+	return payload
+}
+
+// coerceQueryValue guesses the most specific JSON type a raw query
+// string represents, falling back to the string itself.
+func coerceQueryValue(raw string) interface{} {
+	if n, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return n
+	}
+	if n, err := strconv.ParseFloat(raw, 64); err == nil {
+		return n
+	}
+	if b, err := strconv.ParseBool(raw); err == nil {
+		return b
+	}
+	return raw
+}